@@ -0,0 +1,259 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package modsystem
+
+import (
+	"github.com/snapserv/nagopher"
+	"github.com/snapserv/nagopher-checks/shared"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// zfsGlobalStats stores the parsed ARC statistics, which are shared across all pools
+type zfsGlobalStats struct {
+	arcSize   uint64
+	arcHits   uint64
+	arcMisses uint64
+
+	demandDataHits         uint64
+	demandDataMisses       uint64
+	demandMetadataHits     uint64
+	demandMetadataMisses   uint64
+	prefetchDataHits       uint64
+	prefetchDataMisses     uint64
+	prefetchMetadataHits   uint64
+	prefetchMetadataMisses uint64
+	mruHits                uint64
+	mfuHits                uint64
+	l2Hits                 uint64
+	l2Misses               uint64
+	l2Size                 uint64
+}
+
+// arcHitRatio returns the overall ARC hit ratio, expressed as a percentage between 0 and 100
+func (s zfsGlobalStats) arcHitRatio() float64 {
+	return ratioPercent(s.arcHits, s.arcHits+s.arcMisses)
+}
+
+// demandDataHitRatio returns the hit ratio for demand data reads, which are the reads most sensitive to latency
+func (s zfsGlobalStats) demandDataHitRatio() float64 {
+	return ratioPercent(s.demandDataHits, s.demandDataHits+s.demandDataMisses)
+}
+
+// prefetchEfficiency returns the hit ratio for prefetched data and metadata combined
+func (s zfsGlobalStats) prefetchEfficiency() float64 {
+	hits := s.prefetchDataHits + s.prefetchMetadataHits
+	total := hits + s.prefetchDataMisses + s.prefetchMetadataMisses
+	return ratioPercent(hits, total)
+}
+
+// l2HitRatio returns the hit ratio of the L2ARC cache device, if configured
+func (s zfsGlobalStats) l2HitRatio() float64 {
+	return ratioPercent(s.l2Hits, s.l2Hits+s.l2Misses)
+}
+
+// ratioPercent safely computes hits/total as a percentage, returning 0 whenever total is zero
+func ratioPercent(hits, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(total) * 100
+}
+
+// zfsPoolIOStats stores the aggregated I/O counters of a single zfs pool, regardless of whether they were
+// gathered from the legacy per-pool 'io' kstat file or summed up from per-dataset 'objset-*' kstat files
+type zfsPoolIOStats struct {
+	readCount    uint64
+	writeCount   uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	nunlinks     uint64
+	nunlinked    uint64
+}
+
+// zfsPoolStats stores all gathered statistics for a single zfs pool
+type zfsPoolStats struct {
+	state string
+	io    zfsPoolIOStats
+	rate  zfsPoolRateStats
+}
+
+// zfsResource fetches ARC and per-pool statistics through a platform-specific zfsSource
+type zfsResource struct {
+	source      zfsSource
+	globalStats zfsGlobalStats
+	poolStats   map[string]zfsPoolStats
+
+	// statePathTemplate is used to derive the per-pool state file path, with '%s' replaced by the pool name
+	statePathTemplate string
+}
+
+// newZfsResource instantiates a new zfsResource, using the zfsSource implementation registered for this platform
+func newZfsResource(statePathTemplate string) *zfsResource {
+	return &zfsResource{source: newZfsSource(), statePathTemplate: statePathTemplate}
+}
+
+// Probe collects all configured metrics and returns them to the caller
+func (r *zfsResource) Probe(warnings nagopher.WarningCollection) (metrics []nagopher.Metric, _ error) {
+	if err := r.Collect(warnings); err != nil {
+		return nil, err
+	}
+
+	metrics = append(metrics,
+		nagopher.NewNumericMetric("arc_size", float64(r.globalStats.arcSize), "B", nil, ""),
+		nagopher.NewNumericMetric("arc_hits", float64(r.globalStats.arcHits), "c", nil, ""),
+		nagopher.NewNumericMetric("arc_misses", float64(r.globalStats.arcMisses), "c", nil, ""),
+		nagopher.NewNumericMetric("arc_hit_ratio", r.globalStats.arcHitRatio(), "%", nil, ""),
+		nagopher.NewNumericMetric("arc_demand_data_hit_ratio", r.globalStats.demandDataHitRatio(), "%", nil, ""),
+		nagopher.NewNumericMetric("arc_prefetch_efficiency", r.globalStats.prefetchEfficiency(), "%", nil, ""),
+		nagopher.NewNumericMetric("arc_l2_hit_ratio", r.globalStats.l2HitRatio(), "%", nil, ""),
+		nagopher.NewNumericMetric("arc_l2_size", float64(r.globalStats.l2Size), "B", nil, ""),
+	)
+
+	for poolName, poolStats := range r.poolStats {
+		// pool_state is intentionally left to zfsPoolHealthResource, which derives it from 'zpool list' and
+		// is strictly more informative than the one-word kstat state gathered here.
+		metrics = append(metrics,
+			nagopher.NewNumericMetric("pool_read_count", float64(poolStats.io.readCount), "c", nil, poolName),
+			nagopher.NewNumericMetric("pool_write_count", float64(poolStats.io.writeCount), "c", nil, poolName),
+			nagopher.NewNumericMetric("pool_bytes_read", float64(poolStats.io.bytesRead), "B", nil, poolName),
+			nagopher.NewNumericMetric("pool_bytes_written", float64(poolStats.io.bytesWritten), "B", nil, poolName),
+			nagopher.NewNumericMetric("pool_nunlinks", float64(poolStats.io.nunlinks), "c", nil, poolName),
+			nagopher.NewNumericMetric("pool_nunlinked", float64(poolStats.io.nunlinked), "c", nil, poolName),
+		)
+
+		if poolStats.rate.valid {
+			metrics = append(metrics,
+				nagopher.NewNumericMetric("pool_read_bps", poolStats.rate.readBps, "B", nil, poolName),
+				nagopher.NewNumericMetric("pool_write_bps", poolStats.rate.writeBps, "B", nil, poolName),
+				nagopher.NewNumericMetric("pool_read_iops", poolStats.rate.readIOPS, "", nil, poolName),
+				nagopher.NewNumericMetric("pool_write_iops", poolStats.rate.writeIOPS, "", nil, poolName),
+			)
+		} else {
+			warnings.Add(nagopher.NewWarning(
+				"not enough history to compute i/o rates for pool [%s] yet, skipping this invocation", poolName))
+		}
+	}
+
+	return metrics, nil
+}
+
+// zfsSummarizer implements the summarization of check results for the zfs plugin
+type zfsSummarizer struct {
+	*nagopher.BaseSummarizer
+}
+
+// newZfsSummarizer instantiates a new zfsSummarizer
+func newZfsSummarizer() *zfsSummarizer {
+	return &zfsSummarizer{BaseSummarizer: nagopher.NewBaseSummarizer()}
+}
+
+// zfsPlugin implements a Nagios check plugin for monitoring ZFS storage pools and the ARC cache
+type zfsPlugin struct {
+	*shared.BasePlugin
+
+	arcHitRatioWarning         string
+	arcHitRatioCritical        string
+	demandDataHitRatioWarning  string
+	demandDataHitRatioCritical string
+	prefetchEfficiencyWarning  string
+	prefetchEfficiencyCritical string
+	l2HitRatioWarning          string
+	l2HitRatioCritical         string
+
+	statePathTemplate string
+
+	capacityWarning     string
+	capacityCritical    string
+	cksumErrorsCritical string
+}
+
+// newZfsPlugin instantiates a new zfsPlugin
+func newZfsPlugin() *zfsPlugin {
+	return &zfsPlugin{BasePlugin: shared.NewBasePlugin()}
+}
+
+// DefineFlags defines all plugin-specific flags for this plugin
+func (p *zfsPlugin) DefineFlags(cmd *kingpin.CmdClause) {
+	cmd.Flag("arc-hit-ratio-warning", "Warning threshold for the overall ARC hit ratio").
+		StringVar(&p.arcHitRatioWarning)
+	cmd.Flag("arc-hit-ratio-critical", "Critical threshold for the overall ARC hit ratio").
+		StringVar(&p.arcHitRatioCritical)
+	cmd.Flag("arc-demand-data-hit-ratio-warning", "Warning threshold for the demand data ARC hit ratio").
+		StringVar(&p.demandDataHitRatioWarning)
+	cmd.Flag("arc-demand-data-hit-ratio-critical", "Critical threshold for the demand data ARC hit ratio").
+		StringVar(&p.demandDataHitRatioCritical)
+	cmd.Flag("arc-prefetch-efficiency-warning", "Warning threshold for the ARC prefetch efficiency").
+		StringVar(&p.prefetchEfficiencyWarning)
+	cmd.Flag("arc-prefetch-efficiency-critical", "Critical threshold for the ARC prefetch efficiency").
+		StringVar(&p.prefetchEfficiencyCritical)
+	cmd.Flag("arc-l2-hit-ratio-warning", "Warning threshold for the L2ARC hit ratio").
+		StringVar(&p.l2HitRatioWarning)
+	cmd.Flag("arc-l2-hit-ratio-critical", "Critical threshold for the L2ARC hit ratio").
+		StringVar(&p.l2HitRatioCritical)
+
+	cmd.Flag("state-file", "Template for the per-pool state file path, with '%s' replaced by the pool name").
+		Default(zfsDefaultStatePathTemplate).StringVar(&p.statePathTemplate)
+
+	cmd.Flag("capacity-warning", "Warning threshold for the pool capacity usage").StringVar(&p.capacityWarning)
+	cmd.Flag("capacity-critical", "Critical threshold for the pool capacity usage").
+		Default("80").StringVar(&p.capacityCritical)
+	cmd.Flag("cksum-errors-critical", "Critical threshold for the cumulative vdev checksum error count").
+		Default("0").StringVar(&p.cksumErrorsCritical)
+}
+
+// DefineCheck returns the nagopher.Check assembled from the zfsResource and all of its contexts
+func (p *zfsPlugin) DefineCheck() (*nagopher.Check, error) {
+	check := nagopher.NewCheck("zfs", newZfsSummarizer())
+	check.AttachResources(newZfsResource(p.statePathTemplate), newZfsPoolHealthResource())
+	check.AttachContexts(
+		nagopher.NewScalarContext("arc_size", nil, nil),
+		nagopher.NewScalarContext("arc_hits", nil, nil),
+		nagopher.NewScalarContext("arc_misses", nil, nil),
+		nagopher.NewScalarContext("arc_hit_ratio",
+			nagopher.OptionalBoundsFromString(p.arcHitRatioWarning), nagopher.OptionalBoundsFromString(p.arcHitRatioCritical)),
+		nagopher.NewScalarContext("arc_demand_data_hit_ratio",
+			nagopher.OptionalBoundsFromString(p.demandDataHitRatioWarning), nagopher.OptionalBoundsFromString(p.demandDataHitRatioCritical)),
+		nagopher.NewScalarContext("arc_prefetch_efficiency",
+			nagopher.OptionalBoundsFromString(p.prefetchEfficiencyWarning), nagopher.OptionalBoundsFromString(p.prefetchEfficiencyCritical)),
+		nagopher.NewScalarContext("arc_l2_hit_ratio",
+			nagopher.OptionalBoundsFromString(p.l2HitRatioWarning), nagopher.OptionalBoundsFromString(p.l2HitRatioCritical)),
+		nagopher.NewScalarContext("arc_l2_size", nil, nil),
+		nagopher.NewScalarContext("pool_read_count", nil, nil),
+		nagopher.NewScalarContext("pool_write_count", nil, nil),
+		nagopher.NewScalarContext("pool_bytes_read", nil, nil),
+		nagopher.NewScalarContext("pool_bytes_written", nil, nil),
+		nagopher.NewScalarContext("pool_nunlinks", nil, nil),
+		nagopher.NewScalarContext("pool_nunlinked", nil, nil),
+		nagopher.NewScalarContext("pool_read_bps", nil, nil),
+		nagopher.NewScalarContext("pool_write_bps", nil, nil),
+		nagopher.NewScalarContext("pool_read_iops", nil, nil),
+		nagopher.NewScalarContext("pool_write_iops", nil, nil),
+		nagopher.NewScalarContext("pool_capacity_percent",
+			nagopher.OptionalBoundsFromString(p.capacityWarning), nagopher.OptionalBoundsFromString(p.capacityCritical)),
+		nagopher.NewScalarContext("pool_fragmentation_percent", nil, nil),
+		nagopher.NewScalarContext("pool_dedup_ratio", nil, nil),
+		nagopher.NewScalarContext("pool_read_errors", nil, nil),
+		nagopher.NewScalarContext("pool_write_errors", nil, nil),
+		nagopher.NewScalarContext("pool_cksum_errors", nil, nagopher.OptionalBoundsFromString(p.cksumErrorsCritical)),
+		nagopher.NewStringInfoContext("pool_state"),
+	)
+
+	return check, nil
+}
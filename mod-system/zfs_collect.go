@@ -0,0 +1,153 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package modsystem
+
+import (
+	"fmt"
+	"github.com/snapserv/nagopher"
+	"time"
+)
+
+// Collect gathers ARC and per-pool statistics through the configured zfsSource
+func (r *zfsResource) Collect(warnings nagopher.WarningCollection) error {
+	if err := r.collectGlobal(warnings); err != nil {
+		return err
+	}
+
+	if err := r.collectPools(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *zfsResource) collectGlobal(warnings nagopher.WarningCollection) error {
+	metrics, err := r.source.ReadArcStats()
+	if err != nil {
+		warnings.Add(nagopher.NewWarning("could not gather arc statistics: %s", err.Error()))
+		return nil
+	}
+
+	if value, ok := metrics["size"]; ok {
+		r.globalStats.arcSize = value
+	}
+	if value, ok := metrics["hits"]; ok {
+		r.globalStats.arcHits = value
+	}
+	if value, ok := metrics["misses"]; ok {
+		r.globalStats.arcMisses = value
+	}
+	if value, ok := metrics["demand_data_hits"]; ok {
+		r.globalStats.demandDataHits = value
+	}
+	if value, ok := metrics["demand_data_misses"]; ok {
+		r.globalStats.demandDataMisses = value
+	}
+	if value, ok := metrics["demand_metadata_hits"]; ok {
+		r.globalStats.demandMetadataHits = value
+	}
+	if value, ok := metrics["demand_metadata_misses"]; ok {
+		r.globalStats.demandMetadataMisses = value
+	}
+	if value, ok := metrics["prefetch_data_hits"]; ok {
+		r.globalStats.prefetchDataHits = value
+	}
+	if value, ok := metrics["prefetch_data_misses"]; ok {
+		r.globalStats.prefetchDataMisses = value
+	}
+	if value, ok := metrics["prefetch_metadata_hits"]; ok {
+		r.globalStats.prefetchMetadataHits = value
+	}
+	if value, ok := metrics["prefetch_metadata_misses"]; ok {
+		r.globalStats.prefetchMetadataMisses = value
+	}
+	if value, ok := metrics["mru_hits"]; ok {
+		r.globalStats.mruHits = value
+	}
+	if value, ok := metrics["mfu_hits"]; ok {
+		r.globalStats.mfuHits = value
+	}
+	if value, ok := metrics["l2_hits"]; ok {
+		r.globalStats.l2Hits = value
+	}
+	if value, ok := metrics["l2_misses"]; ok {
+		r.globalStats.l2Misses = value
+	}
+	if value, ok := metrics["l2_size"]; ok {
+		r.globalStats.l2Size = value
+	}
+
+	return nil
+}
+
+func (r *zfsResource) collectPools() error {
+	poolNames, err := r.source.ListPools()
+	if err != nil {
+		return fmt.Errorf("could not list zfs pools: %s", err.Error())
+	}
+
+	r.poolStats = make(map[string]zfsPoolStats)
+	for _, poolName := range poolNames {
+		poolStats, err := r.updatePoolStats(poolName)
+		if err != nil {
+			return fmt.Errorf("could not gather zfs pool statistics: %s", err.Error())
+		}
+
+		r.poolStats[poolName] = poolStats
+	}
+
+	return nil
+}
+
+func (r *zfsResource) updatePoolStats(poolName string) (stats zfsPoolStats, _ error) {
+	state, err := r.source.ReadPoolState(poolName)
+	if err != nil {
+		return stats, fmt.Errorf("could not gather state: %s", err.Error())
+	}
+	stats.state = state
+
+	io, err := r.source.ReadPoolIO(poolName)
+	if err != nil {
+		return stats, fmt.Errorf("could not gather i/o stats: %s", err.Error())
+	}
+	stats.io = io
+	stats.rate = r.updatePoolRateStats(poolName, stats.io)
+
+	return stats, nil
+}
+
+// updatePoolRateStats persists the current pool counters to the configured state file and, if a previous
+// state was found, returns the derived throughput/IOPS rates. A failure to read the state file is treated
+// as "no rate available yet" and a failure to write it is ignored, so neither fails the whole check.
+func (r *zfsResource) updatePoolRateStats(poolName string, io zfsPoolIOStats) zfsPoolRateStats {
+	statePath := fmt.Sprintf(r.statePathTemplate, poolName)
+
+	previousState, _ := readZfsPoolState(statePath)
+	currentState := zfsPoolState{
+		Timestamp:    time.Now().Unix(),
+		ReadCount:    io.readCount,
+		WriteCount:   io.writeCount,
+		BytesRead:    io.bytesRead,
+		BytesWritten: io.bytesWritten,
+	}
+
+	_ = writeZfsPoolState(statePath, currentState)
+
+	return computeZfsPoolRates(previousState, currentState)
+}
@@ -0,0 +1,241 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package modsystem
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/snapserv/nagopher"
+)
+
+// zfsVdevErrors stores the READ/WRITE/CKSUM error counters reported by 'zpool status' for a single vdev
+type zfsVdevErrors struct {
+	name        string
+	readErrors  uint64
+	writeErrors uint64
+	cksumErrors uint64
+}
+
+// zfsPoolHealthStats stores capacity, fragmentation and dedup information for a single zfs pool, as well as
+// the error counters of every vdev it is made up of
+type zfsPoolHealthStats struct {
+	health               string
+	capacityPercent      float64
+	fragmentationPercent float64
+	dedupRatio           float64
+	vdevErrors           []zfsVdevErrors
+}
+
+// zfsPoolHealthResource gathers capacity/fragmentation/dedup and per-vdev error statistics by shelling out to
+// the 'zpool' command line tool, since none of that information is exposed through kstats
+type zfsPoolHealthResource struct {
+	poolHealth map[string]zfsPoolHealthStats
+}
+
+// newZfsPoolHealthResource instantiates a new zfsPoolHealthResource
+func newZfsPoolHealthResource() *zfsPoolHealthResource {
+	return &zfsPoolHealthResource{}
+}
+
+// Probe collects all configured metrics and returns them to the caller
+func (r *zfsPoolHealthResource) Probe(warnings nagopher.WarningCollection) (metrics []nagopher.Metric, _ error) {
+	if err := r.Collect(warnings); err != nil {
+		return nil, err
+	}
+
+	for poolName, poolHealth := range r.poolHealth {
+		metrics = append(metrics,
+			nagopher.NewStringMetric("pool_state", poolHealth.health, poolName),
+			nagopher.NewNumericMetric("pool_capacity_percent", poolHealth.capacityPercent, "%", nil, poolName),
+			nagopher.NewNumericMetric("pool_fragmentation_percent", poolHealth.fragmentationPercent, "%", nil, poolName),
+			nagopher.NewNumericMetric("pool_dedup_ratio", poolHealth.dedupRatio, "", nil, poolName),
+		)
+
+		var readErrors, writeErrors, cksumErrors uint64
+		for _, vdevErrors := range poolHealth.vdevErrors {
+			readErrors += vdevErrors.readErrors
+			writeErrors += vdevErrors.writeErrors
+			cksumErrors += vdevErrors.cksumErrors
+
+			if vdevErrors.readErrors > 0 || vdevErrors.writeErrors > 0 || vdevErrors.cksumErrors > 0 {
+				warnings.Add(nagopher.NewWarning("vdev [%s] of pool [%s] reports read=%d write=%d cksum=%d errors",
+					vdevErrors.name, poolName, vdevErrors.readErrors, vdevErrors.writeErrors, vdevErrors.cksumErrors))
+			}
+		}
+
+		metrics = append(metrics,
+			nagopher.NewNumericMetric("pool_read_errors", float64(readErrors), "c", nil, poolName),
+			nagopher.NewNumericMetric("pool_write_errors", float64(writeErrors), "c", nil, poolName),
+			nagopher.NewNumericMetric("pool_cksum_errors", float64(cksumErrors), "c", nil, poolName),
+		)
+	}
+
+	return metrics, nil
+}
+
+// Collect gathers capacity/fragmentation/dedup and per-vdev error statistics for every imported zfs pool
+func (r *zfsPoolHealthResource) Collect(warnings nagopher.WarningCollection) error {
+	poolHealth, err := r.collectPoolList()
+	if err != nil {
+		return fmt.Errorf("could not gather pool capacity statistics: %s", err.Error())
+	}
+
+	vdevErrors, err := r.collectPoolStatus()
+	if err != nil {
+		warnings.Add(nagopher.NewWarning("could not gather vdev error statistics: %s", err.Error()))
+	} else {
+		for poolName, errors := range vdevErrors {
+			if stats, ok := poolHealth[poolName]; ok {
+				stats.vdevErrors = errors
+				poolHealth[poolName] = stats
+			}
+		}
+	}
+
+	r.poolHealth = poolHealth
+
+	return nil
+}
+
+// collectPoolList parses the tabular, parseable output of 'zpool list' into a zfsPoolHealthStats per pool
+func (r *zfsPoolHealthResource) collectPoolList() (map[string]zfsPoolHealthStats, error) {
+	output, err := exec.Command("zpool", "list", "-Hpo", "name,size,alloc,free,frag,cap,dedup,health").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not execute 'zpool list': %s", err.Error())
+	}
+
+	poolHealth := make(map[string]zfsPoolHealthStats)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 8 {
+			continue
+		}
+
+		poolName := fields[0]
+		fragmentationPercent, _ := strconv.ParseFloat(fields[4], 64)
+		capacityPercent, _ := strconv.ParseFloat(fields[5], 64)
+		dedupRatio, _ := strconv.ParseFloat(strings.TrimSuffix(fields[6], "x"), 64)
+
+		poolHealth[poolName] = zfsPoolHealthStats{
+			health:               strings.ToUpper(fields[7]),
+			capacityPercent:      capacityPercent,
+			fragmentationPercent: fragmentationPercent,
+			dedupRatio:           dedupRatio,
+		}
+	}
+
+	return poolHealth, nil
+}
+
+// collectPoolStatus parses 'zpool status -p' to extract the READ/WRITE/CKSUM error counters of every vdev,
+// grouped by the pool they belong to
+func (r *zfsPoolHealthResource) collectPoolStatus() (map[string][]zfsVdevErrors, error) {
+	output, err := exec.Command("zpool", "status", "-p").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not execute 'zpool status': %s", err.Error())
+	}
+
+	// Every row of the config tree (pool -> vdev-group -> leaf disk) reports the *cumulative* error counts
+	// of everything below it, so only leaf rows (disks, files, spares - i.e. rows with no further indented
+	// children) may be summed. configRow buffers one pool's rows until its config section ends, at which
+	// point flush() picks out exactly those.
+	type configRow struct {
+		indent      int
+		name        string
+		readErrors  uint64
+		writeErrors uint64
+		cksumErrors uint64
+	}
+
+	result := make(map[string][]zfsVdevErrors)
+	var currentPool string
+	var rows []configRow
+	inConfig := false
+
+	flush := func() {
+		for i, row := range rows {
+			hasChildren := i < len(rows)-1 && rows[i+1].indent > row.indent
+			if hasChildren || row.name == currentPool {
+				continue
+			}
+
+			result[currentPool] = append(result[currentPool], zfsVdevErrors{
+				name:        row.name,
+				readErrors:  row.readErrors,
+				writeErrors: row.writeErrors,
+				cksumErrors: row.cksumErrors,
+			})
+		}
+
+		rows = nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "pool:"):
+			flush()
+			currentPool = strings.TrimSpace(strings.TrimPrefix(trimmed, "pool:"))
+			inConfig = false
+		case strings.HasPrefix(trimmed, "config:"):
+			inConfig = true
+		case inConfig && trimmed == "" && len(rows) == 0:
+			// A blank line separates 'config:' from the NAME header, so it does not end the section yet.
+		case trimmed == "" || strings.HasPrefix(trimmed, "errors:"):
+			if inConfig {
+				flush()
+			}
+			inConfig = false
+		case inConfig:
+			// A device actively being resilvered/repaired gets a trailing note (e.g. '(resilvering)')
+			// appended after the CKSUM column, so only require the leading NAME/READ/WRITE/CKSUM fields.
+			fields := strings.Fields(trimmed)
+			if len(fields) < 5 || fields[0] == "NAME" || currentPool == "" {
+				continue
+			}
+
+			readErrors, err1 := strconv.ParseUint(fields[2], 10, 64)
+			writeErrors, err2 := strconv.ParseUint(fields[3], 10, 64)
+			cksumErrors, err3 := strconv.ParseUint(fields[4], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+
+			rows = append(rows, configRow{
+				indent:      len(line) - len(strings.TrimLeft(line, " \t")),
+				name:        fields[0],
+				readErrors:  readErrors,
+				writeErrors: writeErrors,
+				cksumErrors: cksumErrors,
+			})
+		}
+	}
+	flush()
+
+	return result, nil
+}
@@ -1,3 +1,5 @@
+// +build linux
+
 /*
  * nagocheck - Reliable and lightweight Nagios plugins written in Go
  * Copyright (C) 2018-2019  Pascal Mathis
@@ -22,167 +24,114 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"github.com/snapserv/nagopher"
-	"io"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/snapserv/nagopher-checks/shared"
 )
 
 const zfsProcBasePath = "/proc/spl/kstat/zfs"
 const zfsProcArcStats = "arcstats"
-const zfsPoolPathPattern = "/*/io"
-
-const (
-	zfsTypeUint64 = "4"
-)
-
-func (r *zfsResource) Collect(warnings nagopher.WarningCollection) error {
-	if err := r.collectGlobal(zfsProcBasePath, warnings); err != nil {
-		return err
-	}
-
-	if err := r.collectPools(zfsProcBasePath); err != nil {
-		return err
-	}
-
-	return nil
+const zfsPoolGlobPattern = "/*"
+const zfsPoolIOStatsFile = "io"
+const zfsPoolObjsetPattern = "objset-*"
+
+// zfsLinuxSource implements zfsSource on top of the procfs files exposed by the ZFS kernel module under
+// /proc/spl/kstat/zfs on Linux
+type zfsLinuxSource struct {
+	basePath string
 }
 
-func (r *zfsResource) collectGlobal(basePath string, warnings nagopher.WarningCollection) error {
-	if file, err := os.Open(filepath.Join(basePath, zfsProcArcStats)); err == nil {
-		if metrics, err := r.parseGlobalStats(file, warnings); err == nil {
-			if value, ok := metrics["size"]; ok {
-				r.globalStats.arcSize = value
-			}
-			if value, ok := metrics["hits"]; ok {
-				r.globalStats.arcHits = value
-			}
-			if value, ok := metrics["misses"]; ok {
-				r.globalStats.arcMisses = value
-			}
-		} else {
-			warnings.Add(nagopher.NewWarning("could not parse arc statistics: %s", err.Error()))
-		}
-	} else {
-		warnings.Add(nagopher.NewWarning("could not gather arc statistics: %s", err.Error()))
-	}
-
-	return nil
+// newZfsSource instantiates the platform-specific zfsSource implementation
+func newZfsSource() zfsSource {
+	return &zfsLinuxSource{basePath: zfsProcBasePath}
 }
 
-func (r *zfsResource) parseGlobalStats(reader io.Reader, warnings nagopher.WarningCollection) (metrics map[string]uint64, _ error) {
-	skipParsing := true
-	scanner := bufio.NewScanner(reader)
-	metrics = make(map[string]uint64)
-
-	for scanner.Scan() {
-		parts := strings.Fields(scanner.Text())
-
-		if skipParsing && len(parts) == 3 && parts[0] == "name" && parts[1] == "type" && parts[2] == "data" {
-			skipParsing = false
-			continue
-		} else if skipParsing || len(parts) < 3 {
-			continue
-		}
-
-		metricKey, metricType, metricValue := parts[0], parts[1], parts[2]
-		switch metricType {
-		case zfsTypeUint64:
-			value, err := strconv.ParseUint(metricValue, 10, 64)
-			if err != nil {
-				warnings.Add(nagopher.NewWarning("could not parse metric [%s] as uint64: %s", metricKey, metricValue))
-				continue
-			}
-
-			metrics[metricKey] = value
-		}
+func (s *zfsLinuxSource) ReadArcStats() (map[string]uint64, error) {
+	file, err := os.Open(filepath.Join(s.basePath, zfsProcArcStats))
+	if err != nil {
+		return nil, fmt.Errorf("could not open arc statistics: %s", err.Error())
 	}
+	defer func() {
+		_ = file.Close()
+	}()
 
-	if skipParsing {
-		return metrics, fmt.Errorf("no global statistics have been parsed")
+	kstats, err := shared.ParseKstat(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse arc statistics: %s", err.Error())
 	}
 
-	return metrics, nil
+	return uint64KstatValues(kstats), nil
 }
 
-func (r *zfsResource) collectPools(basePath string) error {
-	globMatches, err := filepath.Glob(filepath.Join(zfsProcBasePath, zfsPoolPathPattern))
+func (s *zfsLinuxSource) ListPools() ([]string, error) {
+	poolPaths, err := filepath.Glob(filepath.Join(s.basePath, zfsPoolGlobPattern))
 	if err != nil {
-		return fmt.Errorf("could not glob zfs pool paths: %s", err.Error())
-	}
-	if globMatches == nil {
-		return nil
+		return nil, fmt.Errorf("could not glob zfs pool paths: %s", err.Error())
 	}
 
-	r.poolStats = make(map[string]zfsPoolStats)
-	for _, globMatch := range globMatches {
-		poolPath := filepath.Dir(globMatch)
-		poolName := filepath.Base(poolPath)
-		poolStats, err := r.updatePoolStats(poolPath)
-
-		if err != nil {
-			return fmt.Errorf("could not gather zfs pool statistics: %s", err.Error())
+	var poolNames []string
+	for _, poolPath := range poolPaths {
+		if info, err := os.Stat(poolPath); err != nil || !info.IsDir() {
+			continue
 		}
 
-		r.poolStats[poolName] = poolStats
+		poolNames = append(poolNames, filepath.Base(poolPath))
 	}
 
-	return nil
+	return poolNames, nil
 }
 
-func (r *zfsResource) updatePoolStats(poolPath string) (stats zfsPoolStats, _ error) {
-	stateFile, err := os.Open(filepath.Join(poolPath, "state"))
+func (s *zfsLinuxSource) ReadPoolState(poolName string) (string, error) {
+	file, err := os.Open(filepath.Join(s.basePath, poolName, "state"))
 	if err != nil {
-		return stats, fmt.Errorf("could not open state file: %s", err.Error())
+		return "", fmt.Errorf("could not open state file: %s", err.Error())
 	}
 	defer func() {
-		_ = stateFile.Close()
+		_ = file.Close()
 	}()
 
-	ioStatsFile, err := os.Open(filepath.Join(poolPath, "io"))
-	if err != nil {
-		return stats, fmt.Errorf("could not open i/o stats file: %s", err.Error())
-	}
-	defer func() {
-		_ = ioStatsFile.Close()
-	}()
-
-	stats.state, err = r.parsePoolState(stateFile)
-	if err != nil {
-		return stats, fmt.Errorf("could not gather state: %s", err.Error())
-	}
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("could not read state: %s", err.Error())
+		}
 
-	stats.io, err = r.parsePoolIOStats(ioStatsFile)
-	if err != nil {
-		return stats, fmt.Errorf("could not gather i/o stats: %s", err.Error())
+		return "", errors.New("could not read state: EOF")
 	}
 
-	return stats, nil
+	return strings.ToUpper(strings.TrimSpace(scanner.Text())), nil
 }
 
-func (r *zfsResource) parsePoolState(reader io.Reader) (string, error) {
-	scanner := bufio.NewScanner(reader)
-	if !scanner.Scan() {
-		err := scanner.Err()
-		if err == nil {
-			return "", errors.New("could not read state: EOF")
-		}
+func (s *zfsLinuxSource) ReadPoolIO(poolName string) (stats zfsPoolIOStats, _ error) {
+	poolPath := filepath.Join(s.basePath, poolName)
 
-		return "", fmt.Errorf("could not read state: %s", scanner.Err())
+	// ZFS >= 2.1 no longer exposes a single 'io' kstat file per pool, since I/O counters moved into
+	// per-dataset 'objset-*' files instead. Prefer the legacy file when present and fall back to summing
+	// up the objset counters otherwise.
+	if ioStats, ioErr := s.readPoolIOFile(poolPath); ioErr == nil {
+		return ioStats, nil
+	} else if objsetStats, objsetErr := s.readPoolObjsetFiles(poolPath); objsetErr == nil {
+		return objsetStats, nil
+	} else {
+		return stats, fmt.Errorf("could not gather i/o stats: %s / %s", ioErr.Error(), objsetErr.Error())
 	}
-
-	state := strings.ToUpper(strings.TrimSpace(scanner.Text()))
-
-	return state, nil
 }
 
-func (r *zfsResource) parsePoolIOStats(reader io.Reader) (stats zfsPoolIOStats, _ error) {
-	var fields []string
+func (s *zfsLinuxSource) readPoolIOFile(poolPath string) (stats zfsPoolIOStats, _ error) {
+	file, err := os.Open(filepath.Join(poolPath, zfsPoolIOStatsFile))
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
 
+	var fields []string
 	skipParsing := true
-	scanner := bufio.NewScanner(reader)
+	scanner := bufio.NewScanner(file)
 
 	for scanner.Scan() {
 		parts := strings.Fields(scanner.Text())
@@ -215,5 +164,57 @@ func (r *zfsResource) parsePoolIOStats(reader io.Reader) (stats zfsPoolIOStats,
 		}
 	}
 
+	if skipParsing {
+		return stats, fmt.Errorf("no i/o statistics have been parsed")
+	}
+
+	return stats, nil
+}
+
+func (s *zfsLinuxSource) readPoolObjsetFiles(poolPath string) (stats zfsPoolIOStats, _ error) {
+	objsetPaths, err := filepath.Glob(filepath.Join(poolPath, zfsPoolObjsetPattern))
+	if err != nil {
+		return stats, fmt.Errorf("could not glob objset files: %s", err.Error())
+	}
+	if len(objsetPaths) == 0 {
+		return stats, fmt.Errorf("no objset statistics found")
+	}
+
+	for _, objsetPath := range objsetPaths {
+		datasetName := strings.TrimPrefix(filepath.Base(objsetPath), "objset-")
+
+		file, err := os.Open(objsetPath)
+		if err != nil {
+			return stats, fmt.Errorf("could not open objset file for dataset [%s]: %s", datasetName, err.Error())
+		}
+
+		kstats, err := shared.ParseKstat(file)
+		_ = file.Close()
+		if err != nil {
+			return stats, fmt.Errorf("could not parse objset file for dataset [%s]: %s", datasetName, err.Error())
+		}
+
+		metrics := uint64KstatValues(kstats)
+		stats.readCount += metrics["reads"]
+		stats.writeCount += metrics["writes"]
+		stats.bytesRead += metrics["nread"]
+		stats.bytesWritten += metrics["nwritten"]
+		stats.nunlinks += metrics["nunlinks"]
+		stats.nunlinked += metrics["nunlinked"]
+	}
+
 	return stats, nil
 }
+
+// uint64KstatValues discards any signed kstat counters and flattens the rest into a plain map, since pool
+// and ARC statistics are exclusively unsigned counters (kstat type 4)
+func uint64KstatValues(kstats map[string]shared.KstatValue) map[string]uint64 {
+	metrics := make(map[string]uint64, len(kstats))
+	for key, kstat := range kstats {
+		if !kstat.Signed {
+			metrics[key] = kstat.Uint64
+		}
+	}
+
+	return metrics
+}
@@ -0,0 +1,33 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package modsystem
+
+// zfsSource abstracts the operating system specific means of retrieving ZFS statistics, so that zfsResource
+// itself stays free of any procfs/sysctl/kstat implementation details and can run unmodified on every
+// platform which has a registered zfsSource implementation (selected at build time via newZfsSource).
+type zfsSource interface {
+	// ReadArcStats returns the raw ARC kstat counters, keyed by their kstat name
+	ReadArcStats() (map[string]uint64, error)
+	// ListPools returns the names of all currently imported zfs pools
+	ListPools() ([]string, error)
+	// ReadPoolState returns the textual health state (e.g. ONLINE, DEGRADED) of the given pool
+	ReadPoolState(poolName string) (string, error)
+	// ReadPoolIO returns the aggregated I/O counters of the given pool
+	ReadPoolIO(poolName string) (zfsPoolIOStats, error)
+}
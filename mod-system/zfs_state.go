@@ -0,0 +1,104 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package modsystem
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// zfsDefaultStatePathTemplate is used whenever no custom state file path has been configured. The '%s'
+// placeholder is replaced with the pool name, so that concurrent pools do not share a single state file.
+const zfsDefaultStatePathTemplate = "/var/tmp/nagocheck-zfs-%s.state"
+
+// zfsPoolState is persisted to disk between invocations, so i/o counters can be converted into rates
+type zfsPoolState struct {
+	Timestamp    int64  `json:"timestamp"`
+	ReadCount    uint64 `json:"read_count"`
+	WriteCount   uint64 `json:"write_count"`
+	BytesRead    uint64 `json:"bytes_read"`
+	BytesWritten uint64 `json:"bytes_written"`
+}
+
+// zfsPoolRateStats stores the derived throughput and IOPS rates for a single zfs pool. valid is false
+// whenever no meaningful rate could be computed, e.g. on the first run or after a counter reset.
+type zfsPoolRateStats struct {
+	valid     bool
+	readBps   float64
+	writeBps  float64
+	readIOPS  float64
+	writeIOPS float64
+}
+
+// readZfsPoolState reads a previously persisted zfsPoolState from the given path
+func readZfsPoolState(path string) (state zfsPoolState, _ error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return state, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return state, fmt.Errorf("could not decode state file [%s]: %s", path, err.Error())
+	}
+
+	return state, nil
+}
+
+// writeZfsPoolState persists the given zfsPoolState to the given path, overwriting any previous contents
+func writeZfsPoolState(path string, state zfsPoolState) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create state file [%s]: %s", path, err.Error())
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if err := json.NewEncoder(file).Encode(state); err != nil {
+		return fmt.Errorf("could not encode state file [%s]: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// computeZfsPoolRates derives per-second throughput/IOPS rates from the previous and current pool state
+func computeZfsPoolRates(previous, current zfsPoolState) zfsPoolRateStats {
+	elapsed := current.Timestamp - previous.Timestamp
+	if previous.Timestamp == 0 || elapsed <= 0 {
+		return zfsPoolRateStats{}
+	}
+
+	if current.ReadCount < previous.ReadCount || current.WriteCount < previous.WriteCount ||
+		current.BytesRead < previous.BytesRead || current.BytesWritten < previous.BytesWritten {
+		return zfsPoolRateStats{}
+	}
+
+	seconds := float64(elapsed)
+	return zfsPoolRateStats{
+		valid:     true,
+		readBps:   float64(current.BytesRead-previous.BytesRead) / seconds,
+		writeBps:  float64(current.BytesWritten-previous.BytesWritten) / seconds,
+		readIOPS:  float64(current.ReadCount-previous.ReadCount) / seconds,
+		writeIOPS: float64(current.WriteCount-previous.WriteCount) / seconds,
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * nagocheck - Reliable and lightweight Nagios plugins written in Go
+ * Copyright (C) 2018-2019  Pascal Mathis
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shared
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	kstatTypeInt64  = "3"
+	kstatTypeUint64 = "4"
+)
+
+// KstatValue carries the value of a single kstat counter. Kstat type 4 (uint64) is by far the most common
+// and is stored in Uint64; kstat type 3 (int64) is stored in Int64 instead, with Signed indicating which
+// of the two is valid.
+type KstatValue struct {
+	Signed bool
+	Int64  int64
+	Uint64 uint64
+}
+
+// ParseKstat scans a kstat file in the 'name type data' format shared by arcstats, per-dataset objset files
+// and other kstat exports (zfetchstats, dbufstats, dmu_tx, ...), returning every recognized counter keyed by
+// its kstat name
+func ParseKstat(reader io.Reader) (map[string]KstatValue, error) {
+	skipParsing := true
+	scanner := bufio.NewScanner(reader)
+	metrics := make(map[string]KstatValue)
+
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+
+		if skipParsing && len(parts) == 3 && parts[0] == "name" && parts[1] == "type" && parts[2] == "data" {
+			skipParsing = false
+			continue
+		} else if skipParsing || len(parts) < 3 {
+			continue
+		}
+
+		metricKey, metricType, metricValue := parts[0], parts[1], parts[2]
+		switch metricType {
+		case kstatTypeUint64:
+			value, err := strconv.ParseUint(metricValue, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			metrics[metricKey] = KstatValue{Uint64: value}
+		case kstatTypeInt64:
+			value, err := strconv.ParseInt(metricValue, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			metrics[metricKey] = KstatValue{Signed: true, Int64: value}
+		}
+	}
+
+	if skipParsing {
+		return metrics, fmt.Errorf("no kstat data has been parsed")
+	}
+
+	return metrics, nil
+}